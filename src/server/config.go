@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+//rateLimitConfig is read once at startup from the environment.
+type rateLimitConfig struct {
+	backend   string // "memory" (default) or "redis"
+	rps       float64
+	burst     int
+	redisAddr string
+}
+
+func loadRateLimitConfig() rateLimitConfig {
+	cfg := rateLimitConfig{
+		backend:   getEnv("RATE_LIMIT_BACKEND", "memory"),
+		rps:       getEnvFloat("RATE_LIMIT_RPS", 1),
+		burst:     getEnvInt("RATE_LIMIT_BURST", 3),
+		redisAddr: getEnv("REDIS_ADDR", "localhost:6379"),
+	}
+	return cfg
+}
+
+//shutdownDrainTimeout is how long in-flight requests get to finish once a
+//shutdown signal arrives, before the server cuts them off.
+func shutdownDrainTimeout() time.Duration {
+	seconds := getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", 10)
+	return time.Duration(seconds) * time.Second
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fallback
+	}
+	return f
+}
+
+func getEnvInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return fallback
+	}
+	return i
+}
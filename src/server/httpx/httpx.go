@@ -0,0 +1,89 @@
+// Package httpx is a thin shim over fasthttp so handlers don't need to
+// know fasthttp's API directly, and so swapping HTTP engines later only
+// touches this package.
+package httpx
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+//Ctx wraps a *fasthttp.RequestCtx with the handful of helpers handlers in
+//this app actually need.
+type Ctx struct {
+	*fasthttp.RequestCtx
+}
+
+//HandlerFunc is the fasthttp-backed analogue of http.HandlerFunc.
+type HandlerFunc func(ctx *Ctx)
+
+//WriteJSON marshals v and writes it as the response body, tagged as JSON.
+func (c *Ctx) WriteJSON(v interface{}) error {
+	c.SetContentType("application/json")
+	return json.NewEncoder(c).Encode(v)
+}
+
+//QueryParam returns the first value of query param name, or "" if absent.
+func (c *Ctx) QueryParam(name string) string {
+	return string(c.QueryArgs().Peek(name))
+}
+
+//Status sets the response status code.
+func (c *Ctx) Status(code int) {
+	c.SetStatusCode(code)
+}
+
+//Router dispatches requests to a HandlerFunc by path, matching net/http's
+//ServeMux semantics closely enough for this app: exact matches win, and
+//patterns ending in "/" match any path sharing that prefix (longest wins).
+type Router struct {
+	exact  map[string]HandlerFunc
+	prefix []prefixRoute
+}
+
+type prefixRoute struct {
+	prefix  string
+	handler HandlerFunc
+}
+
+func NewRouter() *Router {
+	return &Router{exact: map[string]HandlerFunc{}}
+}
+
+//Handle registers handler for pattern, the same way http.HandleFunc would.
+func (rt *Router) Handle(pattern string, handler HandlerFunc) {
+	if strings.HasSuffix(pattern, "/") {
+		rt.prefix = append(rt.prefix, prefixRoute{prefix: pattern, handler: handler})
+		return
+	}
+	rt.exact[pattern] = handler
+}
+
+//Handler returns the fasthttp.RequestHandler to hand to fasthttp.ListenAndServe.
+func (rt *Router) Handler() fasthttp.RequestHandler {
+	return func(fctx *fasthttp.RequestCtx) {
+		path := string(fctx.Path())
+		ctx := &Ctx{fctx}
+
+		if h, ok := rt.exact[path]; ok {
+			h(ctx)
+			return
+		}
+
+		var best *prefixRoute
+		for i := range rt.prefix {
+			p := &rt.prefix[i]
+			if strings.HasPrefix(path, p.prefix) && (best == nil || len(p.prefix) > len(best.prefix)) {
+				best = p
+			}
+		}
+		if best != nil {
+			best.handler(ctx)
+			return
+		}
+
+		ctx.Status(fasthttp.StatusNotFound)
+	}
+}
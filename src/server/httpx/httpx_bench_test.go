@@ -0,0 +1,50 @@
+package httpx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+//BenchmarkNetHTTPServeMux measures the baseline this package replaced:
+//dispatching a request through net/http's ServeMux to a no-op handler.
+func BenchmarkNetHTTPServeMux(b *testing.B) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/view/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/view/", nil)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+		}
+	})
+}
+
+//BenchmarkRouter measures the same dispatch through the fasthttp-backed
+//Router this package introduces.
+func BenchmarkRouter(b *testing.B) {
+	router := NewRouter()
+	router.Handle("/view/", func(ctx *Ctx) {
+		ctx.Status(fasthttp.StatusOK)
+	})
+	handler := router.Handler()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var fctx fasthttp.RequestCtx
+		var req fasthttp.Request
+		req.SetRequestURI("/view/")
+		fctx.Init(&req, nil, nil)
+
+		for pb.Next() {
+			handler(&fctx)
+		}
+	})
+}
@@ -1,95 +1,66 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/hashicorp/go-memdb"
-	"golang.org/x/time/rate"
-	"log"
 	"math/rand"
-	"net/http"
-	"sync"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tidwall/buntdb"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+	"github.com/wu-geoff/ws-product-golang/src/server/httpx"
+	"github.com/wu-geoff/ws-product-golang/src/server/logging"
+	"github.com/wu-geoff/ws-product-golang/src/server/metrics"
+	"github.com/wu-geoff/ws-product-golang/src/server/ratelimit"
 )
 
-type counters struct {
-	sync.Mutex
-	View  int `json:"view"`
-	Click int `json:"click"`
-}
+//storePath is where the BuntDB file lives on disk.
+const storePath = "counters.db"
 
 var (
-	//A map of map of counters pointers
-	allCounters = map[string]map[string]*counters{}
-
 	//All 4 possible types of content
 	content = []string{"sports", "entertainment", "business", "education"}
 
-	//The in-memory database
-	db *memdb.MemDB
+	//The sharded, lock-free in-memory counters
+	shards = newCounterShard()
 
-	err error
+	//Finalized per-minute snapshots statsHandler reads without locking
+	ring = newCounterRing()
 
-	//The limiter
-	limiter = rate.NewLimiter(1, 3)
-)
+	//The persistent store counters get flushed to
+	db *buntdb.DB
 
-type counter struct {
-	Time    string
-	Content string
-	View    int
-	Click   int
-}
+	err error
 
-//The schema for storage
-var schema = &memdb.DBSchema{
-	Tables: map[string]*memdb.TableSchema{
-		"counters": {
-			Name: "counters",
-			Indexes: map[string]*memdb.IndexSchema{
-				"id": {
-					Name:    "id",
-					Unique:  true,
-					Indexer: &memdb.StringFieldIndex{Field: "Time"},
-				},
-				"content": {
-					Name:    "content",
-					Unique:  false,
-					Indexer: &memdb.IntFieldIndex{Field: "Content"},
-				},
-			},
-		},
-	},
-}
+	//The rate limiter, backend selected by loadRateLimitConfig()
+	limiter ratelimit.RateLimiter
+
+	//ready flips false as soon as a shutdown signal is received, so load
+	//balancers polling /readyz can start draining this instance.
+	ready atomic.Bool
+)
 
-func welcomeHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprint(w, "Welcome to EQ Works 😎")
+func welcomeHandler(ctx *httpx.Ctx) {
+	fmt.Fprint(ctx, "Welcome to EQ Works 😎")
 }
 
-func viewHandler(w http.ResponseWriter, r *http.Request) {
+func viewHandler(ctx *httpx.Ctx) {
 	data := content[rand.Intn(len(content))]
+	logging.SetContent(ctx, data)
 
-	//If counter can be found, increment the view field by 1
-	//If counter can't be found (e.g. when the content was visited for the 1st time in the time period),
-	//then create a new counter and add to the map
-	if counterMap, contentFound := allCounters[data]; contentFound {
-		if counter, counterFound := counterMap[time.Now().Format(time.RFC822Z)]; counterFound {
-			counter.Lock()
-			counter.View++
-			counter.Unlock()
-			counterMap[time.Now().Format(time.RFC822Z)] = counter
-		} else {
-			counterMap[time.Now().Format(time.RFC822Z)] = &counters{
-				View:  1,
-				Click: 0,
-			}
-		}
-	}
+	shards.AddView(data, bucketFor(time.Now()))
+	metrics.ContentViews.WithLabelValues(data).Inc()
 
-	err := processRequest(r)
-	if err != nil {
-		fmt.Println(err)
-		w.WriteHeader(400)
+	if err := processRequest(ctx); err != nil {
+		logging.Log.Debug("processRequest failed", "req_id", logging.RequestID(ctx), "error", err)
+		ctx.Status(400)
 		return
 	}
 
@@ -98,118 +69,231 @@ func viewHandler(w http.ResponseWriter, r *http.Request) {
 		processClick(data)
 	}
 
-	w.WriteHeader(200)
-	fmt.Fprintf(w, "you clicked a \"%s\" type page", data) //Simple message for debugging
+	ctx.Status(200)
+	fmt.Fprintf(ctx, "you clicked a \"%s\" type page", data) //Simple message for debugging
 	return
 
 }
 
-func processRequest(r *http.Request) error {
+func processRequest(ctx *httpx.Ctx) error {
+	start := time.Now()
 	time.Sleep(time.Duration(rand.Int31n(50)) * time.Millisecond)
+	metrics.ProcessRequestSleep.Observe(time.Since(start).Seconds())
 	return nil
 }
 
 func processClick(data string) error {
-	// Look for the right counter, if counter can be found, increment the click field by 1
-	// If counter can't be found, then create the counter and add to the map
-	if counterMap, contentFound := allCounters[data]; contentFound {
-		if counter, counterFound := counterMap[time.Now().Format(time.RFC822Z)]; counterFound {
-			counter.Lock()
-			counter.Click++
-			counter.Unlock()
-			counterMap[time.Now().Format(time.RFC822Z)] = counter
-		} else {
-			counterMap[time.Now().Format(time.RFC822Z)] = &counters{
-				Click: 1,
-				View:  0,
-			}
-		}
-	}
+	shards.AddClick(data, bucketFor(time.Now()))
+	metrics.ContentClicks.WithLabelValues(data).Inc()
 
 	return nil
 }
 
-func statsHandler(w http.ResponseWriter, r *http.Request) {
-	if isAllowed() {
-		//Get the 1st parameter, the type of content
-		content, contentOK := r.URL.Query()["content"] 
+func statsHandler(ctx *httpx.Ctx) {
+	//Get the 1st parameter, the type of content
+	contentParam := ctx.QueryParam("content")
+	if contentParam == "" {
+		ctx.Status(fasthttp.StatusBadRequest)
+		fmt.Fprint(ctx, "Url Param 'content' is missing")
+		return
+	}
 
-		//If either parameter is missing, return a 400 bad request
-		if !contentOK || len(content[0]) < 1 {
-			http.Error(w, "Url Param 'content' is missing", http.StatusBadRequest)
-			return
-		}
+	//Get the 'from'/'to' window to aggregate over, both RFC3339. Default to
+	//the current minute bucket on either side when omitted so a bare
+	//?content= still works like a "right now" query.
+	from := ctx.QueryParam("from")
+	if from == "" {
+		from = bucketFor(time.Now())
+	}
+	to := ctx.QueryParam("to")
+	if to == "" {
+		to = bucketFor(time.Now())
+	}
 
-		//Get the 2nd parameter, the time in RFC822Z format
-		time, timeOK := r.URL.Query()["time"]
-		if !timeOK || len(time[0]) < 1 {
-			http.Error(w, "Url Param 'time' is missing", http.StatusBadRequest)
+	//A single-bucket query is served straight out of the lock-free ring
+	//when that minute has closed and been published there. The in-progress
+	//minute (the common case: "stats right now") is in neither the ring nor
+	//the store yet, so it is read from the live shards. Anything wider, or
+	//not found either way, falls back to BuntDB.
+	var total counterValue
+	if from == to {
+		if fromRing, ok := ring.lookup(contentParam, from); ok {
+			total = fromRing
+		} else if from == bucketFor(time.Now()) {
+			total = shards.snapshotBucket(from)[contentParam]
+		}
+	}
+	if total == (counterValue{}) {
+		var err error
+		total, err = queryCounters(db, contentParam, from, to)
+		if err != nil {
+			ctx.Status(fasthttp.StatusInternalServerError)
+			fmt.Fprint(ctx, err.Error())
 			return
 		}
+	}
 
-		//If the counter can be found, return the JSON representation of it
-		//Otherwise return a 404
-		if counterMap, contentFound := allCounters[content[0]]; contentFound {
-			if counter, counterFound := counterMap[time[0]]; counterFound {
-				fmt.Println(counter.Click)
-				fmt.Println(counter.View)
-
-				countersJSON, _ := json.Marshal(counter)
-				fmt.Println(string(countersJSON))
-				fmt.Fprintln(w, string(countersJSON))
-			} else {
-				http.Error(w, "counter not found :(", http.StatusNotFound)
-			}
-		}
+	countersJSON, _ := json.Marshal(total)
+	fmt.Fprintln(ctx, string(countersJSON))
+}
 
-		return
-	} else {
-		http.Error(w, "you're too fast, please wait :)", http.StatusTooManyRequests)
+//healthzHandler is a liveness check: as long as the process is answering
+//requests at all, it reports healthy.
+func healthzHandler(ctx *httpx.Ctx) {
+	fmt.Fprint(ctx, "ok")
+}
+
+//readyzHandler is a readiness check: it flips to unhealthy once shutdown
+//has started, so a load balancer stops sending new traffic here.
+func readyzHandler(ctx *httpx.Ctx) {
+	if !ready.Load() {
+		ctx.Status(fasthttp.StatusServiceUnavailable)
+		fmt.Fprint(ctx, "shutting down")
 		return
 	}
+	fmt.Fprint(ctx, "ok")
 }
 
-func isAllowed() bool {
-	return limiter.Allow() //The limiter will restrict the rate of access
+//snapshotHandler dumps the raw contents of the persistent store, mostly for
+//debugging / ops poking around.
+func snapshotHandler(ctx *httpx.Ctx) {
+	if err := db.Save(ctx); err != nil {
+		ctx.Status(fasthttp.StatusInternalServerError)
+		fmt.Fprint(ctx, err.Error())
+	}
 }
 
-func uploadCounters(t time.Time) error {
-	txn := db.Txn(true)
-	for content, counters := range allCounters {
-		for time, c := range counters {
-			c.Lock()
-			temp := counter{time, content, c.Click, c.View}
-			c.Unlock()
-			if err := txn.Insert("counters", temp); err != nil {
-				panic(err)
-			}
+//rateLimit wraps handler so every request through it is checked against
+//limiter first, returning 429 with a Retry-After header when the caller is
+//over their budget.
+func rateLimit(handler httpx.HandlerFunc) httpx.HandlerFunc {
+	return func(ctx *httpx.Ctx) {
+		key := ctx.RemoteIP().String()
+		allowed, retryAfter := limiter.Allow(key)
+		if !allowed {
+			metrics.RateLimitRejections.Inc()
+			ctx.Response.Header.Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())+1))
+			ctx.Status(fasthttp.StatusTooManyRequests)
+			fmt.Fprint(ctx, "you're too fast, please wait :)")
+			return
 		}
+
+		handler(ctx)
 	}
-	txn.Commit()
-	return nil
 }
 
-func doEvery(d time.Duration, f func(time.Time) error) {
-	for x := range time.Tick(d) {
-		f(x)
+//uploadCounters flushes every bucket except the one currently being
+//written to. That bucket isn't finalized yet - draining it here would zero
+//it out from under rotateBuckets before the ring gets a chance to publish
+//its full total when the minute closes.
+func uploadCounters(t time.Time) error {
+	return flushCounters(db, shards, bucketFor(t))
+}
+
+//finalFlush drains everything, including the in-flight bucket. It's only
+//called on shutdown, where there's no later periodic flush left to catch
+//that bucket once it closes.
+func finalFlush() error {
+	return flushCounters(db, shards, "")
+}
+
+//doEvery runs f every d until stop is closed, so callers can cancel it
+//cleanly on shutdown instead of leaking the ticker goroutine forever.
+func doEvery(d time.Duration, f func(time.Time) error, stop <-chan struct{}) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case t := <-ticker.C:
+			f(t)
+		case <-stop:
+			return
+		}
 	}
 }
 
 func main() {
-	db, err = memdb.NewMemDB(schema) //Create a new DB at the beginning
+	db, err = openStore(storePath) //Create/open the persistent store at the beginning
 	if err != nil {
 		panic(err)
 	}
 
-	for i := 0; i < len(content); i++ {
-		allCounters[content[i]] = map[string]*counters{}
+	//Check the store is readable. Shards start empty: totals persisted on a
+	//previous run stay in the store and are not loaded back into shards.
+	if err := loadCounters(db, shards); err != nil {
+		panic(err)
+	}
+
+	//stop is closed on shutdown to cancel every background ticker started
+	//below, before the final checkpoint flush.
+	stop := make(chan struct{})
+
+	ready.Store(true)
+
+	go rotateBuckets(shards, ring, stop)
+	go doEvery(10*time.Second, func(time.Time) error {
+		shards.reportShardOccupancy()
+		return nil
+	}, stop)
+	go doEvery(10*time.Second, uploadCounters, stop)
+
+	rlConfig := loadRateLimitConfig()
+	switch rlConfig.backend {
+	case "redis":
+		limiter = ratelimit.NewRedisLimiter(rlConfig.redisAddr, int64(rlConfig.rps), time.Second)
+	default:
+		perKey, err := ratelimit.NewPerKeyLimiter(rlConfig.rps, rlConfig.burst, 10000)
+		if err != nil {
+			panic(err)
+		}
+		limiter = perKey
+		go doEvery(10*time.Second, func(time.Time) error {
+			metrics.RateLimiterActiveKeys.Set(float64(perKey.Len()))
+			return nil
+		}, stop)
 	}
 
-	http.HandleFunc("/", welcomeHandler)
-	http.HandleFunc("/view/", viewHandler)
-	http.HandleFunc("/stats/", statsHandler)
+	router := httpx.NewRouter()
+	router.Handle("/", logging.Middleware("/", metrics.Instrument("/", rateLimit(welcomeHandler))))
+	router.Handle("/view/", logging.Middleware("/view/", metrics.Instrument("/view/", rateLimit(viewHandler))))
+	router.Handle("/stats/", logging.Middleware("/stats/", metrics.Instrument("/stats/", rateLimit(statsHandler))))
+	router.Handle("/snapshot/", logging.Middleware("/snapshot/", metrics.Instrument("/snapshot/", rateLimit(snapshotHandler))))
+	router.Handle("/healthz", healthzHandler)
+	router.Handle("/readyz", readyzHandler)
+
+	metricsHandler := fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+	router.Handle("/metrics", func(ctx *httpx.Ctx) { metricsHandler(ctx.RequestCtx) })
+
+	server := &fasthttp.Server{Handler: router.Handler()}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe(":8080")
+	}()
 
-	//doEvery(50*time.Millisecond, uploadCounters)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			logging.Log.Error("server exited unexpectedly", "error", err)
+		}
+	case sig := <-sigCh:
+		logging.Log.Info("shutting down", "signal", sig.String())
+		ready.Store(false)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownDrainTimeout())
+		defer cancel()
+		if err := server.ShutdownWithContext(ctx); err != nil {
+			logging.Log.Error("error draining connections", "error", err)
+		}
+	}
+
+	close(stop)
+
+	if err := finalFlush(); err != nil {
+		logging.Log.Error("final checkpoint flush failed", "error", err)
+	}
 }
@@ -0,0 +1,81 @@
+// Package metrics holds the Prometheus collectors for the server and the
+// middleware that wires them into every handler.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/wu-geoff/ws-product-golang/src/server/httpx"
+)
+
+var (
+	//RequestCount is the total number of requests served, per path and
+	//status code.
+	RequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_product_requests_total",
+		Help: "Total HTTP requests served, by path and status.",
+	}, []string{"path", "status"})
+
+	//RequestDuration times how long each handler wrapped by Instrument
+	//takes to respond, by path.
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ws_product_request_duration_seconds",
+		Help:    "Request latency in seconds, by path.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"path"})
+
+	//ProcessRequestSleep times the artificial sleep in processRequest.
+	ProcessRequestSleep = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ws_product_process_request_sleep_seconds",
+		Help:    "Time spent sleeping in processRequest.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	//ContentViews and ContentClicks break volume down per content category.
+	ContentViews = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_product_views_total",
+		Help: "Total views, by content category.",
+	}, []string{"content"})
+
+	ContentClicks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_product_clicks_total",
+		Help: "Total clicks, by content category.",
+	}, []string{"content"})
+
+	//RateLimitRejections counts requests turned away by the rate limiter.
+	RateLimitRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_product_rate_limit_rejections_total",
+		Help: "Total requests rejected by the rate limiter.",
+	})
+
+	//RateLimiterActiveKeys reports how many distinct client keys the
+	//in-process rate limiter is currently tracking. Left at 0 when the
+	//Redis backend is in use.
+	RateLimiterActiveKeys = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ws_product_rate_limiter_active_keys",
+		Help: "Distinct client keys currently tracked by the in-process rate limiter.",
+	})
+
+	//ShardOccupancy reports how many content+bucket keys live in each
+	//counter shard, to help size numShards.
+	ShardOccupancy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_product_counter_shard_occupancy",
+		Help: "Number of content+bucket keys tracked by each counter shard.",
+	}, []string{"shard"})
+)
+
+//Instrument wraps handler so every request through it updates
+//RequestCount/RequestDuration for path.
+func Instrument(path string, handler httpx.HandlerFunc) httpx.HandlerFunc {
+	return func(ctx *httpx.Ctx) {
+		start := time.Now()
+
+		handler(ctx)
+
+		RequestDuration.WithLabelValues(path).Observe(time.Since(start).Seconds())
+		RequestCount.WithLabelValues(path, strconv.Itoa(ctx.Response.StatusCode())).Inc()
+	}
+}
@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/time/rate"
+)
+
+//PerKeyLimiter hands each client its own token bucket, keeping only the
+//lruSize most recently seen keys around so memory stays bounded under a
+//large/unbounded set of clients.
+type PerKeyLimiter struct {
+	mu    sync.Mutex
+	cache *lru.Cache
+	rps   rate.Limit
+	burst int
+}
+
+//NewPerKeyLimiter builds an in-process limiter allowing rps requests/sec
+//per key, with the given burst, remembering up to lruSize distinct keys.
+func NewPerKeyLimiter(rps float64, burst, lruSize int) (*PerKeyLimiter, error) {
+	cache, err := lru.New(lruSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PerKeyLimiter{
+		cache: cache,
+		rps:   rate.Limit(rps),
+		burst: burst,
+	}, nil
+}
+
+func (p *PerKeyLimiter) Allow(key string) (bool, time.Duration) {
+	p.mu.Lock()
+	limiter, ok := p.cache.Get(key)
+	if !ok {
+		limiter = rate.NewLimiter(p.rps, p.burst)
+		p.cache.Add(key, limiter)
+	}
+	p.mu.Unlock()
+
+	l := limiter.(*rate.Limiter)
+	reservation := l.Reserve()
+	if !reservation.OK() {
+		return false, 0
+	}
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+//Len reports how many distinct client keys are currently tracked, for the
+//metrics endpoint.
+func (p *PerKeyLimiter) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cache.Len()
+}
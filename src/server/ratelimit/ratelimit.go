@@ -0,0 +1,12 @@
+// Package ratelimit provides pluggable, client-keyed rate limiting
+// backends for the server.
+package ratelimit
+
+import "time"
+
+//RateLimiter decides whether the caller identified by key may proceed.
+//When it returns false, retryAfter is how long the caller should wait
+//before trying again.
+type RateLimiter interface {
+	Allow(key string) (allowed bool, retryAfter time.Duration)
+}
@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+//RedisLimiter implements a fixed-window counter per key in Redis via
+//INCR+EXPIRE, so multiple app replicas share one bucket instead of each
+//tracking its own.
+type RedisLimiter struct {
+	client *redis.Client
+	limit  int64
+	window time.Duration
+}
+
+//NewRedisLimiter allows up to limit requests per key per window, counted
+//against addr.
+func NewRedisLimiter(addr string, limit int64, window time.Duration) *RedisLimiter {
+	return &RedisLimiter{
+		client: redis.NewClient(&redis.Options{Addr: addr}),
+		limit:  limit,
+		window: window,
+	}
+}
+
+func (r *RedisLimiter) Allow(key string) (bool, time.Duration) {
+	ctx := context.Background()
+	redisKey := "ratelimit:" + key
+
+	count, err := r.client.Incr(ctx, redisKey).Result()
+	if err != nil {
+		// Fail open: a Redis outage shouldn't take the whole API down.
+		return true, 0
+	}
+	if count == 1 {
+		r.client.Expire(ctx, redisKey, r.window)
+	}
+
+	if count <= r.limit {
+		return true, 0
+	}
+
+	ttl, err := r.client.TTL(ctx, redisKey).Result()
+	if err != nil || ttl < 0 {
+		ttl = r.window
+	}
+	return false, ttl
+}
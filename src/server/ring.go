@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//ringSize is how many finalized per-minute buckets counterRing keeps
+//around for statsHandler to read without touching the live shards.
+const ringSize = 60
+
+//bucketSnapshot is one immutable, already-aggregated minute of counters.
+//Once published into the ring it is never mutated again.
+type bucketSnapshot struct {
+	bucket string
+	totals map[string]counterValue
+}
+
+//counterRing is a fixed-size ring of bucketSnapshots. Writers publish with
+//an atomic.Value swap, so statsHandler's reads never take a lock.
+type counterRing struct {
+	pos   atomic.Int64
+	slots [ringSize]atomic.Value // each holds *bucketSnapshot
+}
+
+func newCounterRing() *counterRing {
+	return &counterRing{}
+}
+
+//publish appends snap as the newest entry, evicting the oldest once the
+//ring wraps.
+func (r *counterRing) publish(snap *bucketSnapshot) {
+	idx := r.pos.Add(1) % ringSize
+	r.slots[idx].Store(snap)
+}
+
+//lookup returns the totals published for bucket, if still within the ring.
+func (r *counterRing) lookup(content, bucket string) (counterValue, bool) {
+	for i := range r.slots {
+		v := r.slots[i].Load()
+		if v == nil {
+			continue
+		}
+		snap := v.(*bucketSnapshot)
+		if snap.bucket != bucket {
+			continue
+		}
+		total, ok := snap.totals[content]
+		return total, ok
+	}
+	return counterValue{}, false
+}
+
+//snapshotBucket reads (without draining) the current View/Click totals for
+//every known content category in the given bucket.
+func (cs *CounterShard) snapshotBucket(bucket string) map[string]counterValue {
+	totals := map[string]counterValue{}
+	for _, contentName := range content {
+		key := contentName + "|" + bucket
+		s := cs.shardFor(key)
+
+		s.mu.RLock()
+		ctr, ok := s.entries[key]
+		s.mu.RUnlock()
+		if !ok {
+			continue
+		}
+
+		totals[contentName] = counterValue{View: int(ctr.View.Load()), Click: int(ctr.Click.Load())}
+	}
+	return totals
+}
+
+//rotateBuckets runs until stop is closed, publishing a snapshot of the
+//bucket that just closed into ring every minute.
+func rotateBuckets(cs *CounterShard, ring *counterRing, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			closed := bucketFor(now.Add(-time.Minute))
+			ring.publish(&bucketSnapshot{
+				bucket: closed,
+				totals: cs.snapshotBucket(closed),
+			})
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/wu-geoff/ws-product-golang/src/server/metrics"
+)
+
+//numShards controls how many independent locks guard the counter map, and
+//therefore how much the per-counter hotspot mutex from before is spread out.
+const numShards = 32
+
+//counterAtomic is a single content+bucket counter. View/Click are updated
+//with atomic adds, so the hot view/click path only takes its shard's read
+//lock to find the counter, never an exclusive lock once the key exists.
+type counterAtomic struct {
+	View  atomic.Int64
+	Click atomic.Int64
+}
+
+//shard owns a slice of the content+bucket keyspace. Its mutex is only held
+//exclusively for map structure changes (inserting or deleting a key);
+//looking up an existing counter takes the read lock, and incrementing it
+//is a lock-free atomic add.
+type shard struct {
+	mu      sync.RWMutex
+	entries map[string]*counterAtomic
+}
+
+//CounterShard is the sharded replacement for the old allCounters map of
+//maps guarded by a single mutex per counter.
+type CounterShard struct {
+	shards [numShards]*shard
+}
+
+//newCounterShard builds an empty, ready-to-use CounterShard.
+func newCounterShard() *CounterShard {
+	cs := &CounterShard{}
+	for i := range cs.shards {
+		cs.shards[i] = &shard{entries: map[string]*counterAtomic{}}
+	}
+	return cs
+}
+
+//shardFor returns the shard key belongs to.
+func (cs *CounterShard) shardFor(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return cs.shards[h.Sum32()%numShards]
+}
+
+//get returns the counter for content+bucket, creating it if this is the
+//first time that pair has been seen.
+func (cs *CounterShard) get(content, bucket string) *counterAtomic {
+	key := content + "|" + bucket
+	s := cs.shardFor(key)
+
+	s.mu.RLock()
+	ctr, ok := s.entries[key]
+	s.mu.RUnlock()
+	if ok {
+		return ctr
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctr, ok := s.entries[key]; ok {
+		return ctr
+	}
+	ctr = &counterAtomic{}
+	s.entries[key] = ctr
+	return ctr
+}
+
+//AddView increments the view count for content+bucket.
+func (cs *CounterShard) AddView(content, bucket string) {
+	cs.get(content, bucket).View.Add(1)
+}
+
+//AddClick increments the click count for content+bucket.
+func (cs *CounterShard) AddClick(content, bucket string) {
+	cs.get(content, bucket).Click.Add(1)
+}
+
+//drain takes the current View/Click totals out of every entry and zeroes
+//them in place, returning the deltas since the last drain. Used by
+//flushCounters so a restart-safe copy can be handed to the persistent
+//store without holding a shard lock for the whole walk.
+//
+//Entries for excludeBucket are left untouched - that's the bucket still
+//being written to, and rotateBuckets needs to read its full total once it
+//closes, not whatever's trickled in since the last drain. Pass "" to drain
+//everything, including the in-flight bucket (used on final shutdown flush,
+//where there's no later drain to catch it).
+//
+//Entries that come up empty after draining are removed: once a bucket is
+//no longer excludeBucket nothing writes to it again (new writes always
+//land on the current minute), so there's no reason to keep it around.
+func (cs *CounterShard) drain(excludeBucket string) map[string]map[string]counterValue {
+	out := map[string]map[string]counterValue{}
+
+	for _, s := range cs.shards {
+		s.mu.RLock()
+		keys := make([]string, 0, len(s.entries))
+		for k := range s.entries {
+			keys = append(keys, k)
+		}
+		s.mu.RUnlock()
+
+		for _, key := range keys {
+			contentName, bucket := splitCounterShardKey(key)
+			if bucket == excludeBucket {
+				continue
+			}
+
+			s.mu.RLock()
+			ctr, ok := s.entries[key]
+			s.mu.RUnlock()
+			if !ok {
+				continue
+			}
+
+			view := ctr.View.Swap(0)
+			click := ctr.Click.Swap(0)
+			if view == 0 && click == 0 {
+				s.mu.Lock()
+				delete(s.entries, key)
+				s.mu.Unlock()
+				continue
+			}
+
+			byBucket, ok := out[contentName]
+			if !ok {
+				byBucket = map[string]counterValue{}
+				out[contentName] = byBucket
+			}
+			byBucket[bucket] = counterValue{View: int(view), Click: int(click)}
+		}
+	}
+
+	return out
+}
+
+//occupancy reports how many keys live in each shard, for the shard
+//occupancy metric.
+func (cs *CounterShard) occupancy() []int {
+	counts := make([]int, numShards)
+	for i, s := range cs.shards {
+		s.mu.RLock()
+		counts[i] = len(s.entries)
+		s.mu.RUnlock()
+	}
+	return counts
+}
+
+//splitCounterShardKey reverses the "content|bucket" key format get() uses.
+func splitCounterShardKey(key string) (content, bucket string) {
+	for i := 0; i < len(key); i++ {
+		if key[i] == '|' {
+			return key[:i], key[i+1:]
+		}
+	}
+	return key, ""
+}
+
+//reportShardOccupancy publishes per-shard key counts to Prometheus.
+func (cs *CounterShard) reportShardOccupancy() {
+	for i, n := range cs.occupancy() {
+		metrics.ShardOccupancy.WithLabelValues(strconv.Itoa(i)).Set(float64(n))
+	}
+}
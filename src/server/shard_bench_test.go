@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+//legacyCounters is the old mutex-per-counter design being replaced, kept
+//here only so BenchmarkLegacyCounters has something to compare against.
+type legacyCounters struct {
+	sync.Mutex
+	View int
+}
+
+func BenchmarkLegacyCounters(b *testing.B) {
+	var mu sync.Mutex
+	counterMap := map[string]*legacyCounters{}
+	bucket := bucketFor(time.Now())
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			contentName := content[i%len(content)]
+			i++
+
+			mu.Lock()
+			c, ok := counterMap[contentName+bucket]
+			if !ok {
+				c = &legacyCounters{}
+				counterMap[contentName+bucket] = c
+			}
+			mu.Unlock()
+
+			c.Lock()
+			c.View++
+			c.Unlock()
+		}
+	})
+}
+
+func BenchmarkCounterShard(b *testing.B) {
+	cs := newCounterShard()
+	bucket := bucketFor(time.Now())
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cs.AddView(content[i%len(content)], bucket)
+			i++
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+//bucketFormat is the granularity counters are bucketed at: one entry per
+//minute, keyed by its RFC3339 representation so keys sort chronologically.
+const bucketFormat = time.RFC3339
+
+//counterValue is the JSON shape persisted for a single content+minute bucket.
+type counterValue struct {
+	View  int `json:"view"`
+	Click int `json:"click"`
+}
+
+//bucketFor truncates t down to the minute it falls in.
+func bucketFor(t time.Time) string {
+	return t.Truncate(time.Minute).Format(bucketFormat)
+}
+
+//counterKey builds the "counter:{content}:{bucket}" key a counter is stored
+//under.
+func counterKey(content, bucket string) string {
+	return fmt.Sprintf("counter:%s:%s", content, bucket)
+}
+
+//parseCounterKey splits a "counter:{content}:{bucket}" key back into its
+//content and bucket parts.
+func parseCounterKey(key string) (contentName, bucket string) {
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) != 3 {
+		return "", ""
+	}
+	return parts[1], parts[2]
+}
+
+//openStore opens (creating if necessary) the BuntDB file at path. Every key
+//in this store is a "counter:{content}:{bucket}" key, so queryCounters'
+//from/to range scans can walk them in plain key order with the "" (keys
+//tree) index instead of needing a secondary index.
+func openStore(path string) (*buntdb.DB, error) {
+	return buntdb.Open(path)
+}
+
+//loadCounters verifies store is readable on startup. It deliberately does
+//not seed cs with the persisted totals: cs only ever tracks the delta not
+//yet flushed, and store is already the durable source of truth for
+//everything persisted on a previous run. Seeding the live counters here
+//would make flushCounters add that same total back on top of itself on
+//the very next flush.
+func loadCounters(store *buntdb.DB, cs *CounterShard) error {
+	return store.View(func(tx *buntdb.Tx) error {
+		return tx.Ascend("", func(key, value string) bool {
+			return true
+		})
+	})
+}
+
+//flushCounters drains the in-memory deltas out of cs and writes them to
+//store, merging with whatever is already persisted for that content+bucket.
+//excludeBucket is left untouched by the drain - see CounterShard.drain.
+func flushCounters(store *buntdb.DB, cs *CounterShard, excludeBucket string) error {
+	deltas := cs.drain(excludeBucket)
+
+	return store.Update(func(tx *buntdb.Tx) error {
+		for contentName, byBucket := range deltas {
+			for bucket, v := range byBucket {
+				key := counterKey(contentName, bucket)
+
+				if existing, err := tx.Get(key); err == nil {
+					var prev counterValue
+					if err := json.Unmarshal([]byte(existing), &prev); err == nil {
+						v.View += prev.View
+						v.Click += prev.Click
+					}
+				}
+
+				encoded, err := json.Marshal(v)
+				if err != nil {
+					return err
+				}
+				if _, _, err := tx.Set(key, string(encoded), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+//queryCounters aggregates view/click totals for contentName across all
+//buckets in [from, to], both formatted with bucketFormat.
+func queryCounters(store *buntdb.DB, contentName, from, to string) (counterValue, error) {
+	var total counterValue
+
+	err := store.View(func(tx *buntdb.Tx) error {
+		prefix := fmt.Sprintf("counter:%s:", contentName)
+		return tx.AscendGreaterOrEqual("", prefix+from, func(key, value string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			if _, bucket := parseCounterKey(key); bucket > to {
+				return false
+			}
+
+			var v counterValue
+			if err := json.Unmarshal([]byte(value), &v); err != nil {
+				return true
+			}
+			total.View += v.View
+			total.Click += v.Click
+
+			return true
+		})
+	})
+
+	return total, err
+}